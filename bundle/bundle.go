@@ -3,11 +3,16 @@ package bundle
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/suborbital/reactr/directive"
@@ -18,71 +23,104 @@ type FileFunc func(string) ([]byte, error)
 
 // Bundle represents a Runnable bundle
 type Bundle struct {
-	filepath    string
-	Directive   *directive.Directive
-	Runnables   []WasmModuleRef
-	staticFiles map[string]bool
+	filepath   string
+	source     Source
+	Directive  *directive.Directive
+	Runnables  []WasmModuleRef
+	staticRoot *staticEntry
 }
 
-// WasmModuleRef is a reference to a Wasm module (either its filepath or its bytes)
+// Close releases any resources (such as an open file handle) held by the bundle's
+// underlying Source.
+func (b *Bundle) Close() error {
+	if closer, ok := b.source.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// WasmModuleRef is a reference to a Wasm module: its filepath, its bytes, or a lazy
+// handle into the Source it was read from.
 type WasmModuleRef struct {
 	Filepath string
 	Name     string
 	data     []byte
+	lazy     *lazyModule
 }
 
-// StaticFile returns a static file from the bundle, if it exists
+// lazyModule defers reading a module's bytes from its Source until ModuleBytes is
+// called, caching the result (or error) behind a sync.Once so repeated calls don't
+// re-read the archive. It's held behind a pointer on WasmModuleRef so that copying a
+// ref (e.g. into a []WasmModuleRef slice) doesn't copy the sync.Once.
+type lazyModule struct {
+	once         sync.Once
+	source       Source
+	name         string
+	expectedHash string
+	data         []byte
+	err          error
+}
+
+// StaticFile returns a static file from the bundle, if it exists. If the bundle has a
+// manifest, the file's contents are checked against its recorded hash the first time
+// it's requested; a HashMismatchError is returned if they don't match.
 func (b *Bundle) StaticFile(filePath string) ([]byte, error) {
-	if _, exists := b.staticFiles[filePath]; !exists {
-		return nil, os.ErrNotExist
-	}
+	clean := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(filePath, "static/")), "/")
 
-	r, err := zip.OpenReader(b.filepath)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to open bundle")
+	entry := b.staticRoot.find(clean)
+	if entry == nil || entry.isDir {
+		return nil, os.ErrNotExist
 	}
 
-	staticFilePath := ensurePrefix(filePath, "static/")
-
-	var contents []byte
-
-	for _, f := range r.File {
-		if f.Name == staticFilePath {
-			file, err := f.Open()
-			if err != nil {
-				return nil, errors.Wrap(err, "failed to Open static file")
-			}
-
-			contents, err = ioutil.ReadAll(file)
-			if err != nil {
-				return nil, errors.Wrap(err, "failed to ReadAll static file")
-			}
-
-			break
-		}
+	if err := entry.verify(); err != nil {
+		return nil, err
 	}
 
-	return contents, nil
+	return entry.contents, nil
 }
 
-// Write writes a runnable bundle
-// based loosely on https://golang.org/src/archive/zip/example_test.go
-func Write(directive *directive.Directive, files []os.File, staticFiles []os.File, targetPath string) error {
+// Write writes a runnable bundle in the given Format. FormatZip and FormatTarGz write
+// targetPath as a single archive file; FormatOCILayout writes targetPath as a directory
+// containing an OCI image layout. opts may be nil.
+func Write(directive *directive.Directive, files []os.File, staticFiles []os.File, targetPath string, format Format, opts *WriteOptions) error {
 	if directive == nil {
 		return errors.New("directive must be provided")
 	}
 
+	switch format {
+	case FormatTarGz:
+		return writeTarGz(directive, files, staticFiles, targetPath, opts)
+	case FormatOCILayout:
+		return writeOCILayout(directive, files, staticFiles, targetPath, opts)
+	default:
+		return writeZip(directive, files, staticFiles, targetPath, opts)
+	}
+}
+
+// writeZip writes a runnable bundle as a zip archive.
+// based loosely on https://golang.org/src/archive/zip/example_test.go
+func writeZip(directive *directive.Directive, files []os.File, staticFiles []os.File, targetPath string, opts *WriteOptions) error {
 	// Create a buffer to write our archive to.
 	buf := new(bytes.Buffer)
 
 	// Create a new zip archive.
 	w := zip.NewWriter(buf)
 
+	manifest := BundleManifest{Files: map[string]string{}}
+
 	// Add Directive to archive.
-	if err := writeDirective(w, directive); err != nil {
-		return errors.Wrap(err, "failed to writeDirective")
+	directiveBytes, err := directive.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal Directive")
+	}
+
+	if err := writeFile(w, "Directive.yaml", directiveBytes); err != nil {
+		return errors.Wrap(err, "failed to writeFile for Directive")
 	}
 
+	manifest.Files["Directive.yaml"] = hashFile(directiveBytes)
+
 	// Add some files to the archive.
 	for _, file := range files {
 		if file.Name() == "Directive.yaml" || file.Name() == "Directive.yml" {
@@ -95,9 +133,13 @@ func Write(directive *directive.Directive, files []os.File, staticFiles []os.Fil
 			return errors.Wrapf(err, "failed to read file %s", file.Name())
 		}
 
-		if err := writeFile(w, filepath.Base(file.Name()), contents); err != nil {
+		name := filepath.Base(file.Name())
+
+		if err := writeFile(w, name, contents); err != nil {
 			return errors.Wrap(err, "failed to writeFile into bundle")
 		}
+
+		manifest.Files[name] = hashFile(contents)
 	}
 
 	// Add static files to the archive.
@@ -111,6 +153,12 @@ func Write(directive *directive.Directive, files []os.File, staticFiles []os.Fil
 		if err := writeFile(w, fileName, contents); err != nil {
 			return errors.Wrap(err, "failed to writeFile into bundle")
 		}
+
+		manifest.Files[fileName] = hashFile(contents)
+	}
+
+	if err := writeManifest(w, manifest, opts); err != nil {
+		return errors.Wrap(err, "failed to writeManifest")
 	}
 
 	if err := w.Close(); err != nil {
@@ -124,14 +172,26 @@ func Write(directive *directive.Directive, files []os.File, staticFiles []os.Fil
 	return nil
 }
 
-func writeDirective(w *zip.Writer, directive *directive.Directive) error {
-	directiveBytes, err := directive.Marshal()
+// writeManifest marshals manifest, writes it as manifest.json, and, if opts carries a
+// SigningKey, signs it and writes the detached signature as manifest.sig.
+func writeManifest(w *zip.Writer, manifest BundleManifest, opts *WriteOptions) error {
+	manifestBytes, err := json.Marshal(manifest)
 	if err != nil {
-		return errors.Wrap(err, "failed to Marshal Directive")
+		return errors.Wrap(err, "failed to Marshal manifest")
 	}
 
-	if err := writeFile(w, "Directive.yaml", directiveBytes); err != nil {
-		return errors.Wrap(err, "failed to writeFile for Directive")
+	if err := writeFile(w, manifestFileName, manifestBytes); err != nil {
+		return errors.Wrap(err, "failed to writeFile for manifest")
+	}
+
+	if opts == nil || opts.SigningKey == nil {
+		return nil
+	}
+
+	sig := ed25519.Sign(opts.SigningKey, manifestBytes)
+
+	if err := writeFile(w, manifestSigFileName, sig); err != nil {
+		return errors.Wrap(err, "failed to writeFile for manifest signature")
 	}
 
 	return nil
@@ -151,57 +211,139 @@ func writeFile(w *zip.Writer, name string, contents []byte) error {
 	return nil
 }
 
-// Read reads a .wasm.zip file and returns the bundle of wasm modules
-// (suitable to be loaded into a wasmer instance)
-func Read(path string) (*Bundle, error) {
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(path)
+// Read reads a bundle and returns the bundle of wasm modules (suitable to be loaded into
+// a wasmer instance). The format is detected from path: a directory containing an
+// oci-layout file is read as an OCI image layout, any other directory is read via
+// DirSource, and files are sniffed (by extension, falling back to magic bytes) to pick
+// between FormatZip and FormatTarGz. opts may be nil; it controls manifest signature
+// verification. Every blob in an OCI layout is checked against its descriptor's digest,
+// but OCI layouts can't carry a manifest signature (writeOCILayout rejects SigningKey), so
+// RequireSignature is an error against one rather than a silent no-op. Use ReadSource
+// directly to read from a MemorySource, FSSource, or some other pluggable Source.
+func Read(path string, opts *ReadOptions) (*Bundle, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open bundle")
+		return nil, errors.Wrap(err, "failed to Stat bundle path")
 	}
 
-	defer r.Close()
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "oci-layout")); err == nil {
+			if opts != nil && opts.RequireSignature {
+				return nil, errors.New("bundle: RequireSignature is set but FormatOCILayout can't carry a manifest signature")
+			}
+
+			return readOCILayout(path)
+		}
+
+		bundle, err := ReadSource(NewDirSource(path), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.filepath = path
+
+		return bundle, nil
+	}
+
+	format, err := detectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var source Source
+
+	if format == FormatTarGz {
+		tarSource, err := NewTarGzSource(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open bundle")
+		}
+
+		source = tarSource
+	} else {
+		zipSource, err := NewZipSource(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open bundle")
+		}
+
+		source = zipSource
+	}
+
+	bundle, err := ReadSource(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle.filepath = path
+
+	return bundle, nil
+}
+
+// ReadSource reads a bundle from the given Source. opts may be nil.
+func ReadSource(source Source, opts *ReadOptions) (*Bundle, error) {
+	names, err := source.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to List bundle source")
+	}
+
+	manifest, err := loadManifest(source, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	bundle := &Bundle{
-		filepath:    path,
-		Runnables:   []WasmModuleRef{},
-		staticFiles: map[string]bool{},
+		source:     source,
+		Runnables:  []WasmModuleRef{},
+		staticRoot: newStaticDir(""),
 	}
 
-	// Iterate through the files in the archive,
-	for _, f := range r.File {
-		if f.Name == "Directive.yaml" {
-			directive, err := readDirective(f)
+	for _, name := range names {
+		switch {
+		case name == "Directive.yaml":
+			expectedHash, err := manifestHash(manifest, name)
 			if err != nil {
+				return nil, err
+			}
+
+			directive, err := readDirective(source, name, expectedHash)
+			if err != nil {
+				if _, ok := err.(*HashMismatchError); ok {
+					return nil, err
+				}
+
 				return nil, errors.Wrap(err, "failed to readDirective from bundle")
 			}
 
 			bundle.Directive = directive
-			continue
-		} else if strings.HasPrefix(f.Name, "static/") {
-			// build up the list of available static files in the bundle for quick reference later
-			filePath := strings.TrimPrefix(f.Name, "static/")
-			bundle.staticFiles[filePath] = true
-			continue
-		} else if !strings.HasSuffix(f.Name, ".wasm") {
-			continue
-		}
-
-		rc, err := f.Open()
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to open %s from bundle", f.Name)
-		}
+		case strings.HasPrefix(name, "static/"):
+			expectedHash, err := manifestHash(manifest, name)
+			if err != nil {
+				return nil, err
+			}
 
-		defer rc.Close()
+			// read the static file now and insert it into the tree so that HTTPFileSystem
+			// and StaticFile can serve it without going back to the source
+			rc, info, err := source.Open(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to open %s from bundle", name)
+			}
 
-		wasmBytes, err := ioutil.ReadAll(rc)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read %s from bundle", f.Name)
-		}
+			contents, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s from bundle", name)
+			}
 
-		ref := refWithData(f.Name, wasmBytes)
+			bundle.staticRoot.insert(strings.TrimPrefix(name, "static/"), contents, info.ModTime(), expectedHash)
+		case strings.HasSuffix(name, ".wasm"):
+			expectedHash, err := manifestHash(manifest, name)
+			if err != nil {
+				return nil, err
+			}
 
-		bundle.Runnables = append(bundle.Runnables, *ref)
+			// don't read the module now; defer it until ModuleBytes is actually called,
+			// so loading a bundle doesn't pay the memory cost of every runnable it contains
+			bundle.Runnables = append(bundle.Runnables, *refWithSource(source, name, expectedHash))
+		}
 	}
 
 	if bundle.Directive == nil {
@@ -211,15 +353,24 @@ func Read(path string) (*Bundle, error) {
 	return bundle, nil
 }
 
-func readDirective(f *zip.File) (*directive.Directive, error) {
-	file, err := f.Open()
+// readDirective reads and parses name from source. Since the Directive decides what runs,
+// it's verified eagerly (unlike static files and Wasm modules, which are verified lazily
+// on first access) rather than waiting for some later call to surface tampering.
+func readDirective(source Source, name string, expectedHash string) (*directive.Directive, error) {
+	file, _, err := source.Open(name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to open %s from bundle", f.Name)
+		return nil, errors.Wrapf(err, "failed to open %s from bundle", name)
 	}
 
+	defer file.Close()
+
 	directiveBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read %s from bundle", f.Name)
+		return nil, errors.Wrapf(err, "failed to read %s from bundle", name)
+	}
+
+	if expectedHash != "" && hashFile(directiveBytes) != expectedHash {
+		return nil, &HashMismatchError{Name: name}
 	}
 
 	d := &directive.Directive{}
@@ -239,28 +390,64 @@ func refWithData(name string, data []byte) *WasmModuleRef {
 	return ref
 }
 
-// ModuleBytes returns the bytes for the module
+// refWithSource returns a WasmModuleRef that lazily reads its bytes from source on first
+// call to ModuleBytes, rather than eagerly reading them now. If expectedHash is set (from
+// the bundle's manifest), the bytes are checked against it the first time they're read.
+func refWithSource(source Source, name string, expectedHash string) *WasmModuleRef {
+	ref := &WasmModuleRef{
+		Name: name,
+		lazy: &lazyModule{source: source, name: name, expectedHash: expectedHash},
+	}
+
+	return ref
+}
+
+// ModuleBytes returns the bytes for the module, reading them from the module's Source
+// (if it has one) on first call and caching the result for subsequent calls. If the
+// bundle had a manifest, a HashMismatchError is returned (and cached) if the module's
+// contents don't match its recorded hash.
 func (w *WasmModuleRef) ModuleBytes() ([]byte, error) {
-	if w.data == nil {
-		if w.Filepath == "" {
-			return nil, errors.New("missing Wasm module filepath in ref")
-		}
+	if w.data != nil {
+		return w.data, nil
+	}
 
-		bytes, err := ioutil.ReadFile(w.Filepath)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to ReadFile for Wasm module")
-		}
+	if w.lazy != nil {
+		w.lazy.once.Do(func() {
+			rc, _, err := w.lazy.source.Open(w.lazy.name)
+			if err != nil {
+				w.lazy.err = errors.Wrapf(err, "failed to open %s from bundle", w.lazy.name)
+				return
+			}
+
+			defer rc.Close()
+
+			data, err := ioutil.ReadAll(rc)
+			if err != nil {
+				w.lazy.err = errors.Wrapf(err, "failed to read %s from bundle", w.lazy.name)
+				return
+			}
+
+			if w.lazy.expectedHash != "" && hashFile(data) != w.lazy.expectedHash {
+				w.lazy.err = &HashMismatchError{Name: w.lazy.name}
+				return
+			}
+
+			w.lazy.data = data
+		})
 
-		w.data = bytes
+		return w.lazy.data, w.lazy.err
 	}
 
-	return w.data, nil
-}
+	if w.Filepath == "" {
+		return nil, errors.New("missing Wasm module filepath in ref")
+	}
 
-func ensurePrefix(val, prefix string) string {
-	if strings.HasPrefix(val, prefix) {
-		return val
+	data, err := ioutil.ReadFile(w.Filepath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ReadFile for Wasm module")
 	}
 
-	return fmt.Sprintf("%s%s", prefix, val)
+	w.data = data
+
+	return w.data, nil
 }
@@ -0,0 +1,261 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/reactr/directive"
+)
+
+// Format identifies the on-disk container format a bundle is packaged in.
+type Format int
+
+const (
+	// FormatZip packages the bundle as a single zip archive. This is the default format,
+	// and the only one understood by older versions of this package.
+	FormatZip Format = iota
+
+	// FormatTarGz packages the bundle as a gzip-compressed tar archive.
+	FormatTarGz
+
+	// FormatOCILayout packages the bundle as a minimal OCI image layout, suitable for
+	// pushing to a registry with tools such as crane or oras.
+	FormatOCILayout
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// detectFormat sniffs the format of the bundle at path, preferring its extension and
+// falling back to its magic bytes.
+func detectFormat(path string) (Format, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return FormatTarGz, nil
+	case strings.HasSuffix(path, ".zip"), strings.HasSuffix(path, ".wasm.zip"):
+		return FormatZip, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return FormatZip, errors.Wrap(err, "failed to open bundle path")
+	}
+
+	defer f.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return FormatZip, errors.Wrap(err, "failed to read bundle magic bytes")
+	}
+
+	if bytes.Equal(magic, gzipMagic) {
+		return FormatTarGz, nil
+	}
+
+	return FormatZip, nil
+}
+
+// TarGzSource is a Source backed by a gzip-compressed tar archive on local disk. Since
+// tar archives aren't indexed the way zip archives are, the archive is decompressed once
+// up front and its entries kept in memory.
+type TarGzSource struct {
+	files map[string][]byte
+	times map[string]time.Time
+}
+
+// NewTarGzSource opens and indexes the tar.gz archive at path.
+func NewTarGzSource(path string) (*TarGzSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open tar.gz source")
+	}
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open gzip reader")
+	}
+
+	defer gz.Close()
+
+	source := &TarGzSource{
+		files: map[string][]byte{},
+		times: map[string]time.Time{},
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read tar entry")
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read tar entry %s", hdr.Name)
+		}
+
+		source.files[hdr.Name] = contents
+		source.times[hdr.Name] = hdr.ModTime
+	}
+
+	return source, nil
+}
+
+// Open implements Source.
+func (t *TarGzSource) Open(name string) (io.ReadCloser, os.FileInfo, error) {
+	contents, exists := t.files[name]
+	if !exists {
+		return nil, nil, os.ErrNotExist
+	}
+
+	info := memoryFileInfo{name: name, size: int64(len(contents)), modTime: t.times[name]}
+
+	return ioutil.NopCloser(bytes.NewReader(contents)), info, nil
+}
+
+// List implements Source.
+func (t *TarGzSource) List() ([]string, error) {
+	names := make([]string, 0, len(t.files))
+
+	for name := range t.files {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func writeTarGz(directive *directive.Directive, files []os.File, staticFiles []os.File, targetPath string, opts *WriteOptions) error {
+	out, err := os.Create(targetPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create bundle target file")
+	}
+
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	manifest := BundleManifest{Files: map[string]string{}}
+
+	directiveBytes, err := directive.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal Directive")
+	}
+
+	hash, err := writeTarEntry(tw, "Directive.yaml", bytes.NewReader(directiveBytes), int64(len(directiveBytes)))
+	if err != nil {
+		return errors.Wrap(err, "failed to write Directive into bundle")
+	}
+
+	manifest.Files["Directive.yaml"] = hash
+
+	for i := range files {
+		file := &files[i]
+
+		if file.Name() == "Directive.yaml" || file.Name() == "Directive.yml" {
+			continue
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "failed to Stat file %s", file.Name())
+		}
+
+		name := filepath.Base(file.Name())
+
+		hash, err := writeTarEntry(tw, name, file, info.Size())
+		if err != nil {
+			return errors.Wrapf(err, "failed to write file %s into bundle", file.Name())
+		}
+
+		manifest.Files[name] = hash
+	}
+
+	for i := range staticFiles {
+		file := &staticFiles[i]
+
+		info, err := file.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "failed to Stat file %s", file.Name())
+		}
+
+		name := "static/" + filepath.Base(file.Name())
+
+		hash, err := writeTarEntry(tw, name, file, info.Size())
+		if err != nil {
+			return errors.Wrapf(err, "failed to write file %s into bundle", file.Name())
+		}
+
+		manifest.Files[name] = hash
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal manifest")
+	}
+
+	if _, err := writeTarEntry(tw, manifestFileName, bytes.NewReader(manifestBytes), int64(len(manifestBytes))); err != nil {
+		return errors.Wrap(err, "failed to write manifest into bundle")
+	}
+
+	if opts != nil && opts.SigningKey != nil {
+		sig := ed25519.Sign(opts.SigningKey, manifestBytes)
+
+		if _, err := writeTarEntry(tw, manifestSigFileName, bytes.NewReader(sig), int64(len(sig))); err != nil {
+			return errors.Wrap(err, "failed to write manifest signature into bundle")
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close tar writer")
+	}
+
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "failed to close gzip writer")
+	}
+
+	return nil
+}
+
+// writeTarEntry streams r directly into the tar archive rather than buffering its
+// contents, so that large static trees don't need to fit in memory all at once, while
+// still computing its SHA-256 for the bundle manifest along the way.
+func writeTarEntry(tw *tar.Writer, name string, r io.Reader, size int64) (string, error) {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: size,
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", errors.Wrap(err, "failed to WriteHeader for tar entry")
+	}
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(tw, io.TeeReader(r, hasher)); err != nil {
+		return "", errors.Wrap(err, "failed to copy tar entry contents")
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
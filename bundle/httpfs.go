@@ -0,0 +1,203 @@
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticEntry is a single file or directory in a bundle's static asset tree.
+type staticEntry struct {
+	name     string
+	isDir    bool
+	size     int64
+	modTime  time.Time
+	contents []byte
+	children map[string]*staticEntry
+
+	// expectedHash, if set, is the SHA-256 (hex-encoded) this entry's contents are
+	// expected to match, per the bundle's manifest.json. It's checked lazily, once, the
+	// first time the entry is served, by whichever of StaticFile or HTTPFileSystem reads
+	// it first.
+	expectedHash string
+	hashName     string
+	verifyOnce   sync.Once
+	verifyErr    error
+}
+
+// verify checks entry's contents against expectedHash the first time it's called, caching
+// the result for subsequent calls.
+func (e *staticEntry) verify() error {
+	e.verifyOnce.Do(func() {
+		if e.expectedHash != "" && hashFile(e.contents) != e.expectedHash {
+			e.verifyErr = &HashMismatchError{Name: e.hashName}
+		}
+	})
+
+	return e.verifyErr
+}
+
+func newStaticDir(name string) *staticEntry {
+	return &staticEntry{name: name, isDir: true, children: map[string]*staticEntry{}}
+}
+
+// insert adds a file at the given slash-separated path (relative to static/) into the
+// tree, creating any intermediate directories along the way.
+func (e *staticEntry) insert(filePath string, contents []byte, modTime time.Time, expectedHash string) {
+	parts := strings.Split(filePath, "/")
+
+	cur := e
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			cur.children[part] = &staticEntry{
+				name:         part,
+				size:         int64(len(contents)),
+				modTime:      modTime,
+				contents:     contents,
+				expectedHash: expectedHash,
+				hashName:     "static/" + filePath,
+			}
+
+			return
+		}
+
+		child, exists := cur.children[part]
+		if !exists {
+			child = newStaticDir(part)
+			cur.children[part] = child
+		}
+
+		cur = child
+	}
+}
+
+// find locates the entry at the given slash-separated path, relative to the tree root.
+func (e *staticEntry) find(filePath string) *staticEntry {
+	if filePath == "" || filePath == "." {
+		return e
+	}
+
+	cur := e
+	for _, part := range strings.Split(filePath, "/") {
+		if cur == nil || !cur.isDir {
+			return nil
+		}
+
+		cur = cur.children[part]
+	}
+
+	return cur
+}
+
+func (e *staticEntry) Name() string       { return e.name }
+func (e *staticEntry) Size() int64        { return e.size }
+func (e *staticEntry) ModTime() time.Time { return e.modTime }
+func (e *staticEntry) IsDir() bool        { return e.isDir }
+func (e *staticEntry) Sys() interface{}   { return nil }
+
+func (e *staticEntry) Mode() os.FileMode {
+	if e.isDir {
+		return os.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+// httpFile adapts a staticEntry into an http.File.
+type httpFile struct {
+	*bytes.Reader
+	entry *staticEntry
+
+	// dirEntries and dirPos track a directory listing across repeated Readdir calls, per
+	// the http.File/os.File contract: each call with count > 0 advances past the entries
+	// it returns, and a call made once the listing is exhausted returns io.EOF.
+	dirEntries []os.FileInfo
+	dirPos     int
+}
+
+func newHTTPFile(entry *staticEntry) *httpFile {
+	return &httpFile{
+		Reader: bytes.NewReader(entry.contents),
+		entry:  entry,
+	}
+}
+
+func (f *httpFile) Close() error { return nil }
+
+func (f *httpFile) Stat() (os.FileInfo, error) { return f.entry, nil }
+
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.entry.isDir {
+		return nil, fmt.Errorf("%s is not a directory", f.entry.name)
+	}
+
+	if f.dirEntries == nil {
+		infos := make([]os.FileInfo, 0, len(f.entry.children))
+		for _, child := range f.entry.children {
+			infos = append(infos, child)
+		}
+
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+		f.dirEntries = infos
+	}
+
+	if count <= 0 {
+		remaining := f.dirEntries[f.dirPos:]
+		f.dirPos = len(f.dirEntries)
+
+		return remaining, nil
+	}
+
+	if f.dirPos >= len(f.dirEntries) {
+		return nil, io.EOF
+	}
+
+	end := f.dirPos + count
+	if end > len(f.dirEntries) {
+		end = len(f.dirEntries)
+	}
+
+	entries := f.dirEntries[f.dirPos:end]
+	f.dirPos = end
+
+	return entries, nil
+}
+
+// bundleFileSystem is an http.FileSystem backed by a bundle's static asset tree.
+type bundleFileSystem struct {
+	root *staticEntry
+}
+
+// Open implements http.FileSystem.
+func (fs *bundleFileSystem) Open(name string) (http.File, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	entry := fs.root.find(clean)
+	if entry == nil {
+		return nil, os.ErrNotExist
+	}
+
+	if !entry.isDir {
+		if err := entry.verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newHTTPFile(entry), nil
+}
+
+// HTTPFileSystem returns an http.FileSystem rooted at the bundle's static/ directory,
+// suitable for passing directly to http.FileServer or mounting on an http.ServeMux. The
+// directory tree is built once when the bundle is read, so Open does not re-scan the
+// bundle's archive.
+func (b *Bundle) HTTPFileSystem() http.FileSystem {
+	return &bundleFileSystem{root: b.staticRoot}
+}
@@ -0,0 +1,155 @@
+package bundle
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// manifestFileName is the bundle entry holding the content-hash manifest.
+const manifestFileName = "manifest.json"
+
+// manifestSigFileName is the bundle entry holding a detached ed25519 signature over the
+// manifest, present only on signed bundles.
+const manifestSigFileName = "manifest.sig"
+
+// BundleManifest lists the SHA-256 (hex-encoded) hash of every file in a bundle, keyed by
+// the file's archive-relative name (e.g. "Directive.yaml", "static/index.html",
+// "module.wasm"), so that tampering with a bundle after it's written can be detected.
+type BundleManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// WriteOptions configures optional behavior of Write.
+type WriteOptions struct {
+	// SigningKey, if set, causes Write to sign the bundle's manifest.json with ed25519
+	// and include the detached signature as manifest.sig.
+	SigningKey ed25519.PrivateKey
+}
+
+// ReadOptions configures optional verification behavior of Read and ReadSource.
+type ReadOptions struct {
+	// TrustedKeys are the ed25519 public keys a bundle's manifest.sig signature is
+	// accepted from.
+	TrustedKeys []ed25519.PublicKey
+
+	// RequireSignature causes Read to fail unless the bundle has a manifest.sig signed by
+	// one of TrustedKeys.
+	RequireSignature bool
+}
+
+// HashMismatchError is returned by ModuleBytes and StaticFile when a file's contents
+// don't match the hash recorded for it in the bundle's manifest.json, meaning the bundle
+// has been tampered with since it was written.
+type HashMismatchError struct {
+	Name string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("bundle: content hash mismatch for %s, bundle may have been tampered with", e.Name)
+}
+
+func hashFile(contents []byte) string {
+	sum := sha256.Sum256(contents)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func verifyManifestSignature(manifestBytes, sig []byte, trustedKeys []ed25519.PublicKey) bool {
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, manifestBytes, sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadManifest reads and, per opts, verifies the bundle manifest from source. It returns
+// a nil manifest (and no error) if the bundle doesn't have one and a signature isn't
+// required.
+func loadManifest(source Source, opts *ReadOptions) (*BundleManifest, error) {
+	manifestBytes, exists, err := readOptionalSourceFile(source, manifestFileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", manifestFileName)
+	}
+
+	if !exists {
+		if opts != nil && opts.RequireSignature {
+			return nil, errors.Errorf("bundle: signature required but bundle has no %s", manifestFileName)
+		}
+
+		return nil, nil
+	}
+
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to Unmarshal %s", manifestFileName)
+	}
+
+	if opts == nil {
+		return manifest, nil
+	}
+
+	sig, hasSig, err := readOptionalSourceFile(source, manifestSigFileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", manifestSigFileName)
+	}
+
+	switch {
+	case hasSig && len(opts.TrustedKeys) > 0:
+		if !verifyManifestSignature(manifestBytes, sig, opts.TrustedKeys) {
+			return nil, errors.Errorf("bundle: %s signature verification failed", manifestSigFileName)
+		}
+	case opts.RequireSignature && !hasSig:
+		return nil, errors.Errorf("bundle: signature required but %s is not present", manifestSigFileName)
+	case opts.RequireSignature:
+		return nil, errors.Errorf("bundle: signature required but no TrustedKeys configured")
+	}
+
+	return manifest, nil
+}
+
+// manifestHash looks up the expected hash for name in manifest. A nil manifest means the
+// bundle isn't manifest-tracked at all, so verification is skipped for every file ("", nil).
+// A non-nil manifest is treated as closed-world: it's expected to list every file it
+// applies to, so a name it doesn't list is reported as an error rather than silently
+// going unverified, which would otherwise let an unlisted file smuggle past verification.
+func manifestHash(manifest *BundleManifest, name string) (string, error) {
+	if manifest == nil {
+		return "", nil
+	}
+
+	hash, ok := manifest.Files[name]
+	if !ok {
+		return "", errors.Errorf("bundle: %s is not listed in %s", name, manifestFileName)
+	}
+
+	return hash, nil
+}
+
+func readOptionalSourceFile(source Source, name string) ([]byte, bool, error) {
+	rc, _, err := source.Open(name)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
@@ -0,0 +1,230 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/reactr/directive"
+)
+
+// ociDescriptor is a content-addressed pointer to a blob within an OCI layout, per the
+// OCI Image Manifest Specification.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is a minimal OCI image manifest: a config blob (the Directive) plus one
+// layer per runnable and one layer per static asset.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+const ociDirectiveMediaType = "application/vnd.suborbital.directive.v1+yaml"
+const ociRunnableMediaType = "application/vnd.suborbital.runnable.wasm.v1"
+const ociStaticMediaType = "application/vnd.suborbital.static.v1"
+
+// ociTitleAnnotation is the OCI-standard annotation used to recover a layer's original
+// file name, since content-addressed blob names (sha256 digests) don't preserve it.
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+// writeOCILayout writes the bundle as a minimal OCI image layout at targetPath, suitable
+// for pushing to a registry with tools such as crane or oras: a Directive config blob,
+// one layer per runnable, and one layer per static asset.
+func writeOCILayout(directive *directive.Directive, files []os.File, staticFiles []os.File, targetPath string, opts *WriteOptions) error {
+	if opts != nil && opts.SigningKey != nil {
+		return errors.New("bundle: signed manifests aren't supported for FormatOCILayout yet")
+	}
+
+	if err := os.MkdirAll(filepath.Join(targetPath, "blobs", "sha256"), 0755); err != nil {
+		return errors.Wrap(err, "failed to create OCI layout directories")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(targetPath, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return errors.Wrap(err, "failed to write oci-layout")
+	}
+
+	directiveBytes, err := directive.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal Directive")
+	}
+
+	config, err := writeOCIBlob(targetPath, ociDirectiveMediaType, directiveBytes, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to write Directive config blob")
+	}
+
+	layers := make([]ociDescriptor, 0, len(files)+len(staticFiles))
+
+	for i := range files {
+		file := &files[i]
+
+		if file.Name() == "Directive.yaml" || file.Name() == "Directive.yml" {
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read file %s", file.Name())
+		}
+
+		layer, err := writeOCIBlob(targetPath, ociRunnableMediaType, contents, filepath.Base(file.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write layer blob for %s", file.Name())
+		}
+
+		layers = append(layers, layer)
+	}
+
+	for i := range staticFiles {
+		file := &staticFiles[i]
+
+		contents, err := ioutil.ReadAll(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read file %s", file.Name())
+		}
+
+		layer, err := writeOCIBlob(targetPath, ociStaticMediaType, contents, "static/"+filepath.Base(file.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write layer blob for %s", file.Name())
+		}
+
+		layers = append(layers, layer)
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		Config:        config,
+		Layers:        layers,
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal OCI manifest")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(targetPath, "manifest.json"), manifestBytes, 0644); err != nil {
+		return errors.Wrap(err, "failed to write manifest.json")
+	}
+
+	return nil
+}
+
+// writeOCIBlob writes contents to the content-addressed blob store, returning a descriptor
+// for it. If title is non-empty, it's recorded as the blob's org.opencontainers.image.title
+// annotation so its original file name survives the round trip through content-addressed
+// storage.
+func writeOCIBlob(root, mediaType string, contents []byte, title string) (ociDescriptor, error) {
+	sum := sha256.Sum256(contents)
+	digest := hex.EncodeToString(sum[:])
+
+	if err := ioutil.WriteFile(filepath.Join(root, "blobs", "sha256", digest), contents, 0644); err != nil {
+		return ociDescriptor{}, errors.Wrap(err, "failed to write blob")
+	}
+
+	descriptor := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(contents)),
+	}
+
+	if title != "" {
+		descriptor.Annotations = map[string]string{ociTitleAnnotation: title}
+	}
+
+	return descriptor, nil
+}
+
+// readOCILayout reads a bundle packaged as a minimal OCI image layout rooted at root.
+func readOCILayout(root string) (*Bundle, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(root, "manifest.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read OCI manifest.json")
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to Unmarshal OCI manifest.json")
+	}
+
+	directiveBytes, err := readOCIBlob(root, manifest.Config.Digest, "Directive.yaml")
+	if err != nil {
+		if _, ok := err.(*HashMismatchError); ok {
+			return nil, err
+		}
+
+		return nil, errors.Wrap(err, "failed to read Directive config blob")
+	}
+
+	d := &directive.Directive{}
+	if err := d.Unmarshal(directiveBytes); err != nil {
+		return nil, errors.Wrap(err, "failed to Unmarshal Directive")
+	}
+
+	bundle := &Bundle{
+		filepath:   root,
+		Directive:  d,
+		Runnables:  []WasmModuleRef{},
+		staticRoot: newStaticDir(""),
+	}
+
+	for i, layer := range manifest.Layers {
+		name := layer.Annotations[ociTitleAnnotation]
+		if name == "" {
+			if layer.MediaType == ociStaticMediaType {
+				name = fmt.Sprintf("static/layer-%d", i)
+			} else {
+				name = fmt.Sprintf("layer-%d.wasm", i)
+			}
+		}
+
+		contents, err := readOCIBlob(root, layer.Digest, name)
+		if err != nil {
+			if _, ok := err.(*HashMismatchError); ok {
+				return nil, err
+			}
+
+			return nil, errors.Wrapf(err, "failed to read layer blob %s", layer.Digest)
+		}
+
+		switch layer.MediaType {
+		case ociStaticMediaType:
+			bundle.staticRoot.insert(strings.TrimPrefix(name, "static/"), contents, time.Time{}, "")
+		default:
+			bundle.Runnables = append(bundle.Runnables, *refWithData(name, contents))
+		}
+	}
+
+	return bundle, nil
+}
+
+// readOCIBlob reads the blob with the given digest from the content-addressed store and
+// confirms its contents actually hash to that digest before returning them, since a blob
+// read by filename alone is only as trustworthy as the filesystem it's stored on. name is
+// used only to identify the blob in a HashMismatchError.
+func readOCIBlob(root, digest, name string) ([]byte, error) {
+	hash := strings.TrimPrefix(digest, "sha256:")
+
+	contents, err := ioutil.ReadFile(filepath.Join(root, "blobs", "sha256", hash))
+	if err != nil {
+		return nil, err
+	}
+
+	if hashFile(contents) != hash {
+		return nil, &HashMismatchError{Name: name}
+	}
+
+	return contents, nil
+}
@@ -0,0 +1,236 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source is a pluggable source of bundle contents. It abstracts away whether a bundle is
+// backed by a zip archive on disk, an unpacked directory, an in-memory buffer, an fs.FS
+// such as an embed.FS, or some other location entirely (e.g. a remote object store).
+type Source interface {
+	// Open returns a reader and file info for the named entry. The caller is responsible
+	// for closing the returned ReadCloser.
+	Open(name string) (io.ReadCloser, os.FileInfo, error)
+
+	// List returns the names of every file available from the source.
+	List() ([]string, error)
+}
+
+// ZipSource is a Source backed by a zip archive on local disk.
+type ZipSource struct {
+	path string
+	r    *zip.ReadCloser
+}
+
+// NewZipSource opens the zip archive at path and returns a Source backed by it.
+func NewZipSource(path string) (*ZipSource, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open zip source")
+	}
+
+	return &ZipSource{path: path, r: r}, nil
+}
+
+// Open implements Source.
+func (z *ZipSource) Open(name string) (io.ReadCloser, os.FileInfo, error) {
+	for _, f := range z.r.File {
+		if f.Name != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to open %s from zip source", name)
+		}
+
+		return rc, f.FileInfo(), nil
+	}
+
+	return nil, nil, os.ErrNotExist
+}
+
+// List implements Source.
+func (z *ZipSource) List() ([]string, error) {
+	names := make([]string, 0, len(z.r.File))
+
+	for _, f := range z.r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		names = append(names, f.Name)
+	}
+
+	return names, nil
+}
+
+// Close closes the underlying zip archive.
+func (z *ZipSource) Close() error {
+	return z.r.Close()
+}
+
+// DirSource is a Source backed by an unpacked directory on local disk, useful during
+// development when a bundle hasn't been packaged yet.
+type DirSource struct {
+	root string
+}
+
+// NewDirSource returns a Source that reads bundle contents from the directory at root.
+func NewDirSource(root string) *DirSource {
+	return &DirSource{root: root}
+}
+
+// Open implements Source.
+func (d *DirSource) Open(name string) (io.ReadCloser, os.FileInfo, error) {
+	full := filepath.Join(d.root, filepath.FromSlash(name))
+
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+// List implements Source.
+func (d *DirSource) List() ([]string, error) {
+	names := []string{}
+
+	err := filepath.Walk(d.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+
+		names = append(names, filepath.ToSlash(rel))
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk dir source")
+	}
+
+	return names, nil
+}
+
+// MemorySource is a Source backed by an in-memory map of file names to contents.
+type MemorySource struct {
+	files map[string][]byte
+}
+
+// NewMemorySource returns a Source backed by the given map of file name to contents.
+func NewMemorySource(files map[string][]byte) *MemorySource {
+	return &MemorySource{files: files}
+}
+
+// Open implements Source.
+func (m *MemorySource) Open(name string) (io.ReadCloser, os.FileInfo, error) {
+	contents, exists := m.files[name]
+	if !exists {
+		return nil, nil, os.ErrNotExist
+	}
+
+	info := memoryFileInfo{name: filepath.Base(name), size: int64(len(contents))}
+
+	return ioutil.NopCloser(bytes.NewReader(contents)), info, nil
+}
+
+// List implements Source.
+func (m *MemorySource) List() ([]string, error) {
+	names := make([]string, 0, len(m.files))
+
+	for name := range m.files {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) Mode() os.FileMode  { return 0444 }
+func (i memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+// FSSource is a Source backed by an fs.FS, such as an embed.FS compiled into the binary.
+type FSSource struct {
+	fsys fs.FS
+}
+
+// NewFSSource returns a Source backed by the given fs.FS.
+func NewFSSource(fsys fs.FS) *FSSource {
+	return &FSSource{fsys: fsys}
+}
+
+// Open implements Source.
+func (f *FSSource) Open(name string) (io.ReadCloser, os.FileInfo, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+// List implements Source.
+func (f *FSSource) List() ([]string, error) {
+	names := []string{}
+
+	err := fs.WalkDir(f.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		names = append(names, p)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}